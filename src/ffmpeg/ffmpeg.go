@@ -1,14 +1,16 @@
 package ffmpeg
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"math"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 
+	"golang.org/x/sync/errgroup"
+
 	"github.com/schollz/logger"
 	"github.com/schollz/op1-aiff/src/utils"
 )
@@ -18,25 +20,55 @@ type AudioSegment struct {
 	Start    float64
 	End      float64
 	Duration float64
+	// Peaks holds interleaved min/max PCM peaks, one pair per pixel, as
+	// produced by GeneratePeaks. It lets callers render a waveform client-side
+	// without shelling out to audiowaveform/convert.
+	Peaks []int16
+	// Label is an optional human-readable name for the segment, taken from a
+	// subtitle cue or cue-sheet track title. When set, Split uses it to name
+	// the emitted file instead of a bare index.
+	Label string
+	// ReplayGain and ReplayPeak hold the measured gain (dB, relative to the
+	// -18 LUFS ReplayGain 2.0 reference) and true peak (linear amplitude) from
+	// AnalyzeReplayGain, so callers can write REPLAYGAIN_TRACK_GAIN /
+	// REPLAYGAIN_TRACK_PEAK tags into downstream OP-1 AIFFs.
+	ReplayGain float64
+	ReplayPeak float64
 }
 
 const SECONDSATEND = 0.05
 
-// SplitOnSilence splits any audio file based on its silence
-func SplitOnSilence(fname string, silenceDB int, silenceMinimumSeconds float64) (segments []AudioSegment, err error) {
-	out, err := exec.Command("ffmpeg", strings.Fields(fmt.Sprintf("-i %s -af silencedetect=noise=%ddB:d=%2.3f -f null -", fname, silenceDB, silenceMinimumSeconds))...).CombinedOutput()
+// SplitOptions configures how Split fans work out across goroutines.
+type SplitOptions struct {
+	// Workers caps how many segments Split processes concurrently. Zero (the
+	// default) uses runtime.NumCPU().
+	Workers int
+}
+
+// SplitOnSilence splits any audio file based on its silence. ctx may be used
+// to cancel a long-running analysis; onProgress, if non-nil, is called as
+// ffmpeg works through fname.
+func SplitOnSilence(ctx context.Context, fname string, silenceDB int, silenceMinimumSeconds float64, onProgress func(Progress)) (segments []AudioSegment, err error) {
+	totalDuration, err := ffprobeDuration(fname)
+	if err != nil {
+		return
+	}
+
+	args := strings.Fields(fmt.Sprintf("-i %s -af silencedetect=noise=%ddB:d=%2.3f -f null -", fname, silenceDB, silenceMinimumSeconds))
+	out, finalSeconds, err := runFFmpegWithProgress(ctx, args, totalDuration, "silencedetect", fname, onProgress)
 	if err != nil {
 		return
 	}
 	logger.Debugf("ffmpeg output: %s", out)
-	if !strings.Contains(string(out), "silence_end") {
+	if !strings.Contains(out, "silence_end") {
 		err = fmt.Errorf("could not find silence")
 		return
 	}
 
 	var segment AudioSegment
 	segment.Start = 0
-	for _, line := range strings.Split(string(out), "\n") {
+	trailingOpen := false
+	for _, line := range strings.Split(out, "\n") {
 		if strings.Contains(line, "silence_start") {
 			seconds, err := utils.ConvertToSeconds(utils.GetStringInBetween(line+" ", "silence_start: ", " "))
 			if err == nil {
@@ -44,21 +76,25 @@ func SplitOnSilence(fname string, silenceDB int, silenceMinimumSeconds float64)
 				segment.Filename = fname
 				segment.Duration = segment.End - segment.Start
 				segments = append(segments, segment)
+				trailingOpen = false
 			}
 		} else if strings.Contains(line, "silence_end") {
 			seconds, err := utils.ConvertToSeconds(utils.GetStringInBetween(line, "silence_end: ", " "))
 			if err == nil {
 				segment.Start = seconds
-			}
-		} else if strings.Contains(line, "time=") {
-			seconds, err := utils.ConvertToSeconds(utils.GetStringInBetween(line, "time=", " "))
-			if err == nil {
-				segment.End = seconds
-				segment.Duration = segment.End - segment.Start
-				segments = append(segments, segment)
+				trailingOpen = true
 			}
 		}
 	}
+	// the trailing segment, from the last silence_end to the end of the file,
+	// has no silence_start to mark it off; close it using the total time
+	// ffmpeg reported via -progress.
+	if trailingOpen && segment.Start > 0 && finalSeconds > segment.Start {
+		segment.End = finalSeconds
+		segment.Filename = fname
+		segment.Duration = segment.End - segment.Start
+		segments = append(segments, segment)
+	}
 
 	newSegments := make([]AudioSegment, len(segments))
 	i := 0
@@ -76,73 +112,141 @@ func SplitOnSilence(fname string, silenceDB int, silenceMinimumSeconds float64)
 	return newSegments, nil
 }
 
-// Split will take AudioSegments and split them apart
-func Split(segments []AudioSegment, fnamePrefix string, addsilence bool) (splitSegments []AudioSegment, err error) {
+// Split will take AudioSegments and split them apart. When normalizeLoudness
+// is true, each emitted file is additionally loudness-normalized to
+// targetLUFS (via NormalizeLoudness), and its measured ReplayGain and true
+// peak (via AnalyzeReplayGain) are stored on the returned segment's
+// ReplayGain/ReplayPeak fields; no tags are written into the file itself.
+// ctx may be used to cancel a long-running batch split; onProgress, if
+// non-nil, is called as each segment's cut and waveform render progress.
+// Segments are processed across a worker pool sized by opts.Workers (see
+// SplitOptions), so onProgress is called concurrently from multiple
+// goroutines with no ordering guarantee between segments -- it must be
+// safe to call from multiple goroutines at once (e.g. guard any shared
+// state it touches with its own mutex).
+func Split(ctx context.Context, segments []AudioSegment, fnamePrefix string, addsilence bool, normalizeLoudness bool, targetLUFS float64, onProgress func(Progress), opts SplitOptions) (splitSegments []AudioSegment, err error) {
 	splitSegments = make([]AudioSegment, len(segments))
+
+	workers := opts.Workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(workers)
 	for i := range segments {
-		splitSegments[i] = segments[i]
-		splitSegments[i].Filename = fmt.Sprintf("%s%d.wav", fnamePrefix, i)
-		splitSegments[i].Duration += 0.1
-		var out []byte
-		cmd := fmt.Sprintf("-y -i %s -acodec copy -ss %2.8f -to %2.8f 0%s", segments[i].Filename, segments[i].Start, segments[i].End, splitSegments[i].Filename)
-		if !addsilence {
-			cmd = fmt.Sprintf("-y -i %s -acodec copy -ss %2.8f -to %2.8f %s", segments[i].Filename, segments[i].Start, segments[i].End, splitSegments[i].Filename)
-		}
-		logger.Debug(cmd)
-		out, err = exec.Command("ffmpeg", strings.Fields(cmd)...).CombinedOutput()
+		i := i
+		g.Go(func() error {
+			splitSegment, splitErr := splitOneSegment(gctx, segments[i], i, fnamePrefix, addsilence, normalizeLoudness, targetLUFS, onProgress)
+			if splitErr != nil {
+				return splitErr
+			}
+			splitSegments[i] = splitSegment
+			return nil
+		})
+	}
+	if err = g.Wait(); err != nil {
+		return
+	}
+
+	// generate a merged waveform image from the concatenated peaks, preserving order
+	var mergedPeaks []int16
+	for i := range splitSegments {
+		mergedPeaks = append(mergedPeaks, splitSegments[i].Peaks...)
+	}
+	err = WaveformPNG(mergedPeaks, fmt.Sprintf("%s-merge.png", fnamePrefix), len(mergedPeaks)/2, 80)
+	if err != nil {
+		logger.Errorf("WaveformPNG: %s", err.Error())
+		return
+	}
+
+	return
+}
+
+// splitOneSegment cuts (and, optionally, pads/normalizes) a single segment
+// and renders its waveform. It is the per-segment unit of work Split fans
+// out across its worker pool.
+func splitOneSegment(ctx context.Context, segment AudioSegment, i int, fnamePrefix string, addsilence bool, normalizeLoudness bool, targetLUFS float64, onProgress func(Progress)) (splitSegment AudioSegment, err error) {
+	splitSegment = segment
+	if segment.Label != "" {
+		splitSegment.Filename = fmt.Sprintf("%s%d-%s.wav", fnamePrefix, i, sanitizeLabel(segment.Label))
+	} else {
+		splitSegment.Filename = fmt.Sprintf("%s%d.wav", fnamePrefix, i)
+	}
+	splitSegment.Duration += 0.1
+	cmd := fmt.Sprintf("-y -i %s -acodec copy -ss %2.8f -to %2.8f 0%s", segment.Filename, segment.Start, segment.End, splitSegment.Filename)
+	if !addsilence {
+		cmd = fmt.Sprintf("-y -i %s -acodec copy -ss %2.8f -to %2.8f %s", segment.Filename, segment.Start, segment.End, splitSegment.Filename)
+	}
+	_, _, err = runFFmpegWithProgress(ctx, strings.Fields(cmd), splitSegment.Duration, "cut", splitSegment.Filename, onProgress)
+	if err != nil {
+		return
+	}
+	if addsilence {
+		// -af 'apad=pad_dur=SECONDSATEND' adds SECONDSATEND seconds of silence to the end
+		cmd = fmt.Sprintf("-y -i 0%s -af apad=pad_dur=%2.3f %s", splitSegment.Filename, SECONDSATEND, splitSegment.Filename)
+		_, _, err = runFFmpegWithProgress(ctx, strings.Fields(cmd), splitSegment.Duration, "pad", splitSegment.Filename, onProgress)
 		if err != nil {
-			logger.Errorf("ffmpeg: %s", out)
 			return
 		}
-		if addsilence {
-			// -af 'apad=pad_dur=0.1' adds SECONDSATEND milliseconds of silence to the end
-			cmd = fmt.Sprintf("-y -i 0%s -af apad=pad_dur=%2.3f %s", splitSegments[i].Filename, SECONDSATEND, splitSegments[i].Filename)
-			logger.Debug(cmd)
-			out, err = exec.Command("ffmpeg", strings.Fields(cmd)...).CombinedOutput()
-			if err != nil {
-				logger.Errorf("ffmpeg: %s", out)
-				return
-			}
-			os.Remove(fmt.Sprintf("0%s", splitSegments[i].Filename))
-		}
+		os.Remove(fmt.Sprintf("0%s", splitSegment.Filename))
 	}
+	if normalizeLoudness {
+		var normalizedFname string
+		normalizedFname, err = NormalizeLoudness(splitSegment.Filename, targetLUFS)
+		if err != nil {
+			logger.Errorf("NormalizeLoudness: %s", err.Error())
+			return
+		}
+		os.Remove(splitSegment.Filename)
+		os.Rename(normalizedFname, splitSegment.Filename)
 
-	// also generate the audio waveform image for each
-	colors := []string{"7FFFD4", "F5F5DC"}
-	allfnames := make([]string, len(splitSegments))
-	for i := range splitSegments {
-		allfnames[i] = fmt.Sprintf("%s.png", splitSegments[i].Filename)
-		var out []byte
-		color := colors[int(math.Mod(float64(i), 2))]
-		cmd := fmt.Sprintf("-i %s -o %s.png --background-color ffffff00 --waveform-color %s --amplitude-scale 1 --no-axis-labels --pixels-per-second 100 --height 80 --width %2.0f", splitSegments[i].Filename, splitSegments[i].Filename, color, splitSegments[i].Duration*100)
-		logger.Debug(cmd)
-		out, err = exec.Command("audiowaveform", strings.Fields(cmd)...).CombinedOutput()
+		splitSegment.ReplayGain, splitSegment.ReplayPeak, err = AnalyzeReplayGain(splitSegment.Filename)
 		if err != nil {
-			logger.Errorf("audiowaveform: %s", out)
+			logger.Errorf("AnalyzeReplayGain: %s", err.Error())
 			return
 		}
 	}
-	// generate a merged audio waveform image
-	cmd := fmt.Sprintf("%s +append %s-merge.png", strings.Join(allfnames, " "), fnamePrefix)
-	logger.Debug(cmd)
-	out, err := exec.Command("convert", strings.Fields(cmd)...).CombinedOutput()
+
+	splitSegment.Peaks, err = GeneratePeaks(splitSegment.Filename, samplesPerPixel())
+	if err != nil {
+		logger.Errorf("GeneratePeaks: %s", err.Error())
+		return
+	}
+	if onProgress != nil {
+		onProgress(Progress{Percent: 100, CurrentFile: splitSegment.Filename, Stage: "waveform", Peaks: splitSegment.Peaks})
+	}
+	err = WaveformPNG(splitSegment.Peaks, fmt.Sprintf("%s.png", splitSegment.Filename), int(splitSegment.Duration*100), 80)
 	if err != nil {
-		logger.Errorf("convert: %s", out)
+		logger.Errorf("WaveformPNG: %s", err.Error())
 		return
 	}
-
 	return
 }
 
-// Merge takes audio segments and creates merges of at most `secondsInEachMerge` seconds
-func Merge(segments []AudioSegment, fnamePrefix string, secondsInEachMerge float64) (mergedSegments []AudioSegment, err error) {
+// samplesPerPixel is the downsample rate that keeps GeneratePeaks output
+// in line with the 100px/second waveforms this package has always rendered.
+func samplesPerPixel() int {
+	const sampleRate = 44100
+	const pixelsPerSecond = 100
+	perPixel := sampleRate / pixelsPerSecond
+	if perPixel < 1 {
+		perPixel = 1
+	}
+	return perPixel
+}
+
+// Merge takes audio segments and creates merges of at most `secondsInEachMerge` seconds.
+// ctx may be used to cancel a long-running batch merge; onProgress, if
+// non-nil, is called as each merged file is concatenated and rendered.
+func Merge(ctx context.Context, segments []AudioSegment, fnamePrefix string, secondsInEachMerge float64, onProgress func(Progress)) (mergedSegments []AudioSegment, err error) {
 	fnamesToMerge := []string{}
 	currentLength := 0.0
 	mergeNum := 0
 	for _, segment := range segments {
 		if segment.Duration+currentLength > secondsInEachMerge {
 			var mergeSegment AudioSegment
-			mergeSegment, err = MergeAudioFiles(fnamesToMerge, fmt.Sprintf("%s%d.wav", fnamePrefix, mergeNum))
+			mergeSegment, err = MergeAudioFiles(ctx, fnamesToMerge, fmt.Sprintf("%s%d.wav", fnamePrefix, mergeNum), onProgress)
 			if err != nil {
 				return
 			}
@@ -155,7 +259,7 @@ func Merge(segments []AudioSegment, fnamePrefix string, secondsInEachMerge float
 		currentLength += segment.Duration
 	}
 	var mergeSegment AudioSegment
-	mergeSegment, err = MergeAudioFiles(fnamesToMerge, fmt.Sprintf("%s%d.wav", fnamePrefix, mergeNum))
+	mergeSegment, err = MergeAudioFiles(ctx, fnamesToMerge, fmt.Sprintf("%s%d.wav", fnamePrefix, mergeNum), onProgress)
 	if err != nil {
 		return
 	}
@@ -164,13 +268,17 @@ func Merge(segments []AudioSegment, fnamePrefix string, secondsInEachMerge float
 	return
 }
 
-func MergeAudioFiles(fnames []string, outfname string) (segment AudioSegment, err error) {
+// MergeAudioFiles concatenates fnames into outfname. ctx may be used to
+// cancel; onProgress, if non-nil, is called as the concat and waveform
+// render progress.
+func MergeAudioFiles(ctx context.Context, fnames []string, outfname string, onProgress func(Progress)) (segment AudioSegment, err error) {
 	f, err := ioutil.TempFile(os.TempDir(), "merge")
 	if err != nil {
 		return
 	}
 	// defer os.Remove(f.Name())
 
+	var totalDuration float64
 	for _, fname := range fnames {
 		fname, err = filepath.Abs(fname)
 		if err != nil {
@@ -180,31 +288,37 @@ func MergeAudioFiles(fnames []string, outfname string) (segment AudioSegment, er
 		if err != nil {
 			return
 		}
+		var fnameDuration float64
+		fnameDuration, err = ffprobeDuration(fname)
+		if err != nil {
+			return
+		}
+		totalDuration += fnameDuration
 	}
 	f.Close()
 
 	cmd := fmt.Sprintf("-y -f concat -safe 0 -i %s -c copy %s", f.Name(), outfname)
-	logger.Debug(cmd)
-	out, err := exec.Command("ffmpeg", strings.Fields(cmd)...).CombinedOutput()
-	logger.Debugf("ffmpeg: %s", out)
+	_, finalSeconds, err := runFFmpegWithProgress(ctx, strings.Fields(cmd), totalDuration, "merge", outfname, onProgress)
 	if err != nil {
-		err = fmt.Errorf("ffmpeg; %s", err.Error())
 		return
 	}
-	seconds, err := utils.ConvertToSeconds(utils.GetStringInBetween(string(out), "time=", " bitrate"))
 
-	segment.Duration = seconds
-	segment.End = seconds
+	segment.Duration = finalSeconds
+	segment.End = finalSeconds
 	segment.Filename = outfname
 
-	// create audio waveform
-	cmd = fmt.Sprintf("-i %s -o %s.png --background-color ffffff00 --waveform-color ffffff --amplitude-scale 1 --no-axis-labels --pixels-per-second 100 --height 80 --width %2.0f",
-		segment.Filename, segment.Filename, segment.Duration*100,
-	)
-	logger.Debug(cmd)
-	out, err = exec.Command("audiowaveform", strings.Fields(cmd)...).CombinedOutput()
+	// create audio waveform peaks/image natively
+	segment.Peaks, err = GeneratePeaks(segment.Filename, samplesPerPixel())
+	if err != nil {
+		logger.Errorf("GeneratePeaks: %s", err.Error())
+		return
+	}
+	if onProgress != nil {
+		onProgress(Progress{Percent: 100, CurrentFile: segment.Filename, Stage: "waveform", Peaks: segment.Peaks})
+	}
+	err = WaveformPNG(segment.Peaks, fmt.Sprintf("%s.png", segment.Filename), int(segment.Duration*100), 80)
 	if err != nil {
-		logger.Errorf("audiowaveform: %s", out)
+		logger.Errorf("WaveformPNG: %s", err.Error())
 		return
 	}
 	return
@@ -0,0 +1,129 @@
+package ffmpeg
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/schollz/logger"
+)
+
+// replayGainReferenceLUFS is the ReplayGain 2.0 reference loudness; measured
+// track gain is reported relative to it.
+const replayGainReferenceLUFS = -18.0
+
+// AnalyzeReplayGain measures the integrated loudness and true peak of fname
+// with ffmpeg's ebur128 filter and returns the ReplayGain-style track gain
+// (dB, relative to the -18 LUFS reference) and true peak (linear amplitude).
+func AnalyzeReplayGain(fname string) (gainDB, peak float64, err error) {
+	cmd := exec.Command("ffmpeg", "-i", fname, "-af", "ebur128=peak=true", "-f", "null", "-")
+	logger.Debug(cmd.String())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		logger.Errorf("ffmpeg: %s", out)
+		return
+	}
+
+	integrated, _, peakDB, err := parseEbur128Summary(string(out))
+	if err != nil {
+		return
+	}
+
+	gainDB = replayGainReferenceLUFS - integrated
+	peak = math.Pow(10, peakDB/20)
+	return
+}
+
+// parseEbur128Summary pulls the integrated loudness ("I:"), loudness range
+// ("LRA:"), and true peak ("Peak:") out of the summary block ffmpeg's
+// ebur128 filter writes to stderr.
+func parseEbur128Summary(output string) (integrated, lra, peakDB float64, err error) {
+	var foundI, foundPeak bool
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "I:"):
+			integrated, err = parseEbur128Field(trimmed, "I:", "LUFS")
+			if err != nil {
+				return
+			}
+			foundI = true
+		case strings.HasPrefix(trimmed, "LRA:"):
+			lra, err = parseEbur128Field(trimmed, "LRA:", "LU")
+		case strings.HasPrefix(trimmed, "Peak:"):
+			peakDB, err = parseEbur128Field(trimmed, "Peak:", "dBFS")
+			if err != nil {
+				return
+			}
+			foundPeak = true
+		}
+	}
+	if !foundI || !foundPeak {
+		err = fmt.Errorf("could not find ebur128 summary in ffmpeg output")
+	}
+	return
+}
+
+func parseEbur128Field(line, prefix, suffix string) (float64, error) {
+	value := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(strings.TrimPrefix(line, prefix)), suffix))
+	return strconv.ParseFloat(value, 64)
+}
+
+type loudnormMeasured struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// NormalizeLoudness two-pass normalizes fname to targetLUFS integrated
+// loudness with ffmpeg's loudnorm filter (TP=-1.5, LRA=11) and writes the
+// result to a new file, whose name it returns.
+func NormalizeLoudness(fname string, targetLUFS float64) (outFname string, err error) {
+	firstPass := exec.Command("ffmpeg", "-i", fname, "-af",
+		fmt.Sprintf("loudnorm=I=%2.1f:TP=-1.5:LRA=11:print_format=json", targetLUFS),
+		"-f", "null", "-")
+	logger.Debug(firstPass.String())
+	out, err := firstPass.CombinedOutput()
+	if err != nil {
+		logger.Errorf("ffmpeg: %s", out)
+		return
+	}
+
+	var measured loudnormMeasured
+	measured, err = parseLoudnormJSON(string(out))
+	if err != nil {
+		return
+	}
+
+	outFname = fmt.Sprintf("%s-normalized.wav", strings.TrimSuffix(fname, ".wav"))
+	secondPass := exec.Command("ffmpeg", "-y", "-i", fname, "-af",
+		fmt.Sprintf("loudnorm=I=%2.1f:TP=-1.5:LRA=11:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true:print_format=summary",
+			targetLUFS, measured.InputI, measured.InputTP, measured.InputLRA, measured.InputThresh, measured.TargetOffset),
+		outFname)
+	logger.Debug(secondPass.String())
+	out, err = secondPass.CombinedOutput()
+	if err != nil {
+		logger.Errorf("ffmpeg: %s", out)
+		return
+	}
+	return
+}
+
+// parseLoudnormJSON extracts the measured_* JSON object the loudnorm
+// filter's first pass writes to stderr, so it can be fed back into the
+// second (gated) pass.
+func parseLoudnormJSON(output string) (measured loudnormMeasured, err error) {
+	start := strings.Index(output, "{")
+	end := strings.LastIndex(output, "}")
+	if start == -1 || end == -1 || end < start {
+		err = fmt.Errorf("could not find loudnorm measurement JSON in ffmpeg output")
+		return
+	}
+	err = json.Unmarshal([]byte(output[start:end+1]), &measured)
+	return
+}
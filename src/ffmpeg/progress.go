@@ -0,0 +1,115 @@
+package ffmpeg
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/schollz/logger"
+)
+
+// Progress reports how far a long-running Split/Merge operation has gotten,
+// so a caller (e.g. the OP-1 web frontend) can render a real progress bar
+// instead of a blocking spinner. Split's onProgress callback is invoked
+// concurrently from its worker pool, so any callback passed in must be
+// safe to call from multiple goroutines at once.
+type Progress struct {
+	Percent     float64
+	CurrentFile string
+	Stage       string
+	// Peaks is set only for waveform-generating stages, and carries the
+	// peaks computed so far for CurrentFile.
+	Peaks []int16
+}
+
+// ffprobeDuration returns the duration of fname in seconds, via ffprobe.
+func ffprobeDuration(fname string) (seconds float64, err error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1", fname).CombinedOutput()
+	if err != nil {
+		logger.Errorf("ffprobe: %s", out)
+		return
+	}
+	seconds, err = strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	return
+}
+
+// runFFmpegWithProgress runs ffmpeg with the given arguments, streaming
+// `-progress pipe:1 -nostats` key=value lines from stdout to compute percent
+// complete (out_time_ms / totalDurationSeconds) and calling onProgress as it
+// goes. stderr (ffmpeg's normal logging, e.g. silencedetect/loudnorm filter
+// output) is drained on its own goroutine, collected, and returned so callers
+// can still parse it. The child is killed if ctx is canceled.
+func runFFmpegWithProgress(ctx context.Context, args []string, totalDurationSeconds float64, stage, currentFile string, onProgress func(Progress)) (stderrOutput string, lastSeconds float64, err error) {
+	fullArgs := append([]string{"-progress", "pipe:1", "-nostats"}, args...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", fullArgs...)
+	logger.Debug(cmd.String())
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return
+	}
+
+	if err = cmd.Start(); err != nil {
+		return
+	}
+
+	var stderrLines []string
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			stderrLines = append(stderrLines, scanner.Text())
+		}
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "out_time_ms":
+			outTimeMicros, convErr := strconv.ParseInt(value, 10, 64)
+			if convErr != nil {
+				continue
+			}
+			lastSeconds = float64(outTimeMicros) / 1e6
+			if onProgress == nil || totalDurationSeconds <= 0 {
+				continue
+			}
+			percent := lastSeconds / totalDurationSeconds * 100
+			if percent > 100 {
+				percent = 100
+			}
+			onProgress(Progress{Percent: percent, CurrentFile: currentFile, Stage: stage})
+		case "progress":
+			if value == "end" && onProgress != nil {
+				onProgress(Progress{Percent: 100, CurrentFile: currentFile, Stage: stage})
+			}
+		}
+	}
+
+	<-stderrDone
+	stderrOutput = strings.Join(stderrLines, "\n")
+	waitErr := cmd.Wait()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+		return
+	}
+	if waitErr != nil {
+		logger.Errorf("ffmpeg: %s", stderrOutput)
+		err = fmt.Errorf("ffmpeg: %w", waitErr)
+	}
+	return
+}
@@ -0,0 +1,173 @@
+package ffmpeg
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/schollz/op1-aiff/src/utils"
+)
+
+var cueTimestampRe = regexp.MustCompile(`(\d{2,}:\d{2}(?::\d{2})?[.,]\d{2,3})\s*-->\s*(\d{2,}:\d{2}(?::\d{2})?[.,]\d{2,3})`)
+
+// SplitOnSubtitles reads a WebVTT/SRT file and produces one AudioSegment per
+// cue, with Start/End taken from the cue timing and the cue text carried on
+// Label so it flows through to Split's output filenames. This lets a source
+// be chopped by transcript rather than by silence.
+func SplitOnSubtitles(audioFname, subFname string) (segments []AudioSegment, err error) {
+	f, err := os.Open(subFname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var cur *AudioSegment
+	var textLines []string
+	// textDone marks that a blank line has closed off the current cue's text
+	// block; any further lines until the next cue timestamp (an SRT index,
+	// a WebVTT NOTE/STYLE block, ...) are not part of this cue's label.
+	var textDone bool
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		cur.Label = strings.TrimSpace(strings.Join(textLines, " "))
+		cur.Duration = cur.End - cur.Start
+		segments = append(segments, *cur)
+		cur = nil
+		textLines = nil
+		textDone = false
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := cueTimestampRe.FindStringSubmatch(line); m != nil {
+			flush()
+			start, errStart := utils.ConvertToSeconds(normalizeSubripTimestamp(m[1]))
+			end, errEnd := utils.ConvertToSeconds(normalizeSubripTimestamp(m[2]))
+			if errStart != nil {
+				err = errStart
+				return
+			}
+			if errEnd != nil {
+				err = errEnd
+				return
+			}
+			cur = &AudioSegment{Filename: audioFname, Start: start, End: end}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			textDone = true
+			continue
+		}
+		if textDone {
+			continue
+		}
+		textLines = append(textLines, trimmed)
+	}
+	flush()
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	if len(segments) == 0 {
+		err = fmt.Errorf("could not find any subtitle cues in %s", subFname)
+	}
+	return
+}
+
+// normalizeSubripTimestamp turns an SRT-style "00:01:23,456" timestamp into
+// the "00:01:23.456" form ConvertToSeconds expects.
+func normalizeSubripTimestamp(ts string) string {
+	return strings.Replace(ts, ",", ".", 1)
+}
+
+var cueIndexRe = regexp.MustCompile(`^\s*INDEX\s+01\s+(\d+):(\d{2}):(\d{2})\s*$`)
+var cueTitleRe = regexp.MustCompile(`^\s*TITLE\s+"(.*)"\s*$`)
+
+// SplitOnCueSheet reads a standard .cue sheet and produces one AudioSegment
+// per track, named from the track's TITLE where present. INDEX 01 timestamps
+// are MM:SS:FF with 75 frames per second, per the Red Book cue sheet format.
+func SplitOnCueSheet(audioFname, cueFname string) (segments []AudioSegment, err error) {
+	f, err := os.Open(cueFname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var starts []float64
+	var titles []string
+	var curTitle string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, "TRACK ") {
+			curTitle = ""
+			continue
+		}
+		if m := cueTitleRe.FindStringSubmatch(line); m != nil {
+			curTitle = m[1]
+			continue
+		}
+		if m := cueIndexRe.FindStringSubmatch(line); m != nil {
+			minutes, _ := strconv.Atoi(m[1])
+			seconds, _ := strconv.Atoi(m[2])
+			frames, _ := strconv.Atoi(m[3])
+			starts = append(starts, float64(minutes*60+seconds)+float64(frames)/75.0)
+			titles = append(titles, curTitle)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	if len(starts) == 0 {
+		err = fmt.Errorf("could not find any INDEX 01 entries in %s", cueFname)
+		return
+	}
+
+	audioDuration, err := ffprobeDuration(audioFname)
+	if err != nil {
+		return
+	}
+
+	for i, start := range starts {
+		segment := AudioSegment{
+			Filename: audioFname,
+			Start:    start,
+			Label:    titles[i],
+		}
+		if i+1 < len(starts) {
+			segment.End = starts[i+1]
+		} else {
+			segment.End = audioDuration
+		}
+		segment.Duration = segment.End - segment.Start
+		segments = append(segments, segment)
+	}
+	return
+}
+
+var labelSanitizeRe = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// sanitizeLabel turns arbitrary cue/subtitle text into something safe to use
+// as (part of) a filename.
+func sanitizeLabel(label string) string {
+	label = labelSanitizeRe.ReplaceAllString(label, "-")
+	label = strings.Trim(label, "-")
+	if len(label) > 40 {
+		label = label[:40]
+	}
+	if label == "" {
+		label = "untitled"
+	}
+	return label
+}
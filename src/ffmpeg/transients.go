@@ -0,0 +1,184 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+
+	"github.com/schollz/logger"
+)
+
+const transientSampleRate = 44100
+
+// SplitOnTransients decodes fname to mono PCM and splits it on detected
+// percussive onsets rather than silence, so closely-spaced or overlapping
+// hits (breakbeats, drum loops) can still be chopped into OP-1 drum-patch
+// slots. sensitivity scales the adaptive peak-picking threshold (higher
+// picks fewer, stronger onsets); minGapSeconds enforces a minimum spacing
+// between accepted onsets.
+func SplitOnTransients(fname string, sensitivity float64, minGapSeconds float64) (segments []AudioSegment, err error) {
+	cmd := exec.Command("ffmpeg", "-i", fname, "-f", "s16le", "-ac", "1", "-ar", fmt.Sprintf("%d", transientSampleRate), "-")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	pcm, readErr := io.ReadAll(stdout)
+	waitErr := cmd.Wait()
+	if waitErr != nil {
+		logger.Errorf("ffmpeg: %s", stderr.String())
+		err = fmt.Errorf("ffmpeg: %w", waitErr)
+		return
+	}
+	if readErr != nil {
+		err = readErr
+		return
+	}
+
+	samples := make([]float64, len(pcm)/2)
+	for i := range samples {
+		samples[i] = float64(int16(uint16(pcm[2*i]) | uint16(pcm[2*i+1])<<8))
+	}
+
+	envelope := onsetEnvelope(samples)
+	onsetFrames := pickOnsets(envelope, sensitivity, minGapSeconds)
+
+	const hopSize = transientWindowSize / 2
+	const preRoll = 0.005
+	const minSegmentSeconds = 0.1
+
+	for i, frame := range onsetFrames {
+		start := float64(frame*hopSize)/transientSampleRate - preRoll
+		if start < 0 {
+			start = 0
+		}
+		end := float64(len(samples)) / transientSampleRate
+		if i+1 < len(onsetFrames) {
+			end = float64(onsetFrames[i+1]*hopSize)/transientSampleRate - preRoll
+		}
+		// cover the lead-in before the first onset (e.g. room tone or a
+		// quiet pickup) rather than silently discarding it, same as
+		// SplitOnSilence always starting its first segment at 0.
+		if i == 0 && start > 0 {
+			segments = append(segments, AudioSegment{
+				Filename: fname,
+				Start:    0,
+				End:      start,
+				Duration: start,
+			})
+		}
+		if end-start < minSegmentSeconds {
+			continue
+		}
+		segments = append(segments, AudioSegment{
+			Filename: fname,
+			Start:    start,
+			End:      end,
+			Duration: end - start,
+		})
+	}
+
+	if len(segments) == 0 {
+		err = fmt.Errorf("could not find any transients")
+	}
+	return
+}
+
+// transientWindowSize is ~10ms at 44.1kHz, rounded to a power of two.
+const transientWindowSize = 512
+
+// onsetEnvelope computes a short-time energy envelope over Hann-windowed
+// frames with 50% overlap, then returns the positive first-difference of
+// that envelope (a simple spectral-flux-like onset detection function).
+func onsetEnvelope(samples []float64) []float64 {
+	hop := transientWindowSize / 2
+	numFrames := 0
+	if len(samples) > transientWindowSize {
+		numFrames = (len(samples)-transientWindowSize)/hop + 1
+	}
+
+	energy := make([]float64, numFrames)
+	for f := 0; f < numFrames; f++ {
+		start := f * hop
+		var sum float64
+		for i := 0; i < transientWindowSize; i++ {
+			window := 0.5 * (1 - math.Cos(2*math.Pi*float64(i)/float64(transientWindowSize-1)))
+			sample := samples[start+i] * window
+			sum += sample * sample
+		}
+		energy[f] = math.Sqrt(sum / transientWindowSize)
+	}
+
+	flux := make([]float64, numFrames)
+	for f := 1; f < numFrames; f++ {
+		diff := energy[f] - energy[f-1]
+		if diff > 0 {
+			flux[f] = diff
+		}
+	}
+	return flux
+}
+
+// pickOnsets peak-picks the onset envelope with an adaptive threshold
+// (mean + sensitivity*stddev over a ~200ms sliding window), enforcing a
+// minimum gap between accepted onsets.
+func pickOnsets(envelope []float64, sensitivity float64, minGapSeconds float64) (onsetFrames []int) {
+	const hop = transientWindowSize / 2
+	framesPerSecond := float64(transientSampleRate) / float64(hop)
+	medianWindow := int(0.2 * framesPerSecond)
+	if medianWindow < 1 {
+		medianWindow = 1
+	}
+	minGapFrames := int(minGapSeconds * framesPerSecond)
+
+	lastOnset := -minGapFrames - 1
+	for f := range envelope {
+		lo := f - medianWindow/2
+		if lo < 0 {
+			lo = 0
+		}
+		hi := f + medianWindow/2
+		if hi > len(envelope) {
+			hi = len(envelope)
+		}
+		window := envelope[lo:hi]
+
+		mean := meanOf(window)
+		threshold := mean + sensitivity*stddevOf(window, mean)
+
+		if envelope[f] > threshold && envelope[f] > 0 && f-lastOnset >= minGapFrames {
+			onsetFrames = append(onsetFrames, f)
+			lastOnset = f
+		}
+	}
+	return
+}
+
+func meanOf(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func stddevOf(values []float64, mean float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sumSq float64
+	for _, v := range values {
+		d := v - mean
+		sumSq += d * d
+	}
+	return math.Sqrt(sumSq / float64(len(values)))
+}
@@ -0,0 +1,131 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/schollz/logger"
+)
+
+// GeneratePeaks decodes fname with ffmpeg into raw 16-bit mono PCM and
+// reduces it to a slice of interleaved min/max peaks, one pair per
+// samplesPerPixel window. The result is suitable for drawing a waveform
+// without needing the original audio file around.
+func GeneratePeaks(fname string, samplesPerPixel int) (peaks []int16, err error) {
+	if samplesPerPixel < 1 {
+		samplesPerPixel = 1
+	}
+
+	cmd := exec.Command("ffmpeg", "-i", fname, "-f", "s16le", "-acodec", "pcm_s16le", "-ac", "1", "-")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err = cmd.Start(); err != nil {
+		return
+	}
+
+	pcm, readErr := io.ReadAll(stdout)
+	waitErr := cmd.Wait()
+	if waitErr != nil {
+		logger.Errorf("ffmpeg: %s", stderr.String())
+		err = fmt.Errorf("ffmpeg: %w", waitErr)
+		return
+	}
+	if readErr != nil {
+		err = readErr
+		return
+	}
+
+	numSamples := len(pcm) / 2
+	for i := 0; i < numSamples; i += samplesPerPixel {
+		var min, max int16
+		end := i + samplesPerPixel
+		if end > numSamples {
+			end = numSamples
+		}
+		first := true
+		for j := i; j < end; j++ {
+			sample := int16(uint16(pcm[2*j]) | uint16(pcm[2*j+1])<<8)
+			if first {
+				min, max = sample, sample
+				first = false
+				continue
+			}
+			if sample < min {
+				min = sample
+			}
+			if sample > max {
+				max = sample
+			}
+		}
+		if first {
+			break
+		}
+		peaks = append(peaks, min, max)
+	}
+
+	return
+}
+
+// WaveformPNG renders a min/max peaks slice (as produced by GeneratePeaks)
+// to a PNG file at outFname, at the given pixel dimensions.
+func WaveformPNG(peaks []int16, outFname string, width, height int) (err error) {
+	if width < 1 {
+		width = len(peaks) / 2
+	}
+	if height < 1 {
+		height = 80
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	waveColor := color.RGBA{0x7F, 0xFF, 0xD4, 0xFF}
+	mid := height / 2
+
+	numPairs := len(peaks) / 2
+	for x := 0; x < width; x++ {
+		i := 0
+		if numPairs > 0 {
+			i = x * numPairs / width
+		}
+		if i >= numPairs {
+			continue
+		}
+		min, max := peaks[2*i], peaks[2*i+1]
+		yTop := mid - int(float64(max)/float64(1<<15)*float64(mid))
+		yBottom := mid - int(float64(min)/float64(1<<15)*float64(mid))
+		if yTop > yBottom {
+			yTop, yBottom = yBottom, yTop
+		}
+		for y := yTop; y <= yBottom; y++ {
+			if y >= 0 && y < height {
+				img.Set(x, y, waveColor)
+			}
+		}
+	}
+
+	f, err := os.Create(outFname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	err = png.Encode(f, img)
+	return
+}
+
+// PeaksJSON serializes a peaks slice so callers building the OP-1 web UI
+// can render waveforms client-side without invoking external binaries.
+func PeaksJSON(peaks []int16) (out []byte, err error) {
+	out, err = json.Marshal(peaks)
+	return
+}